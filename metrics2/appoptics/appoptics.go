@@ -6,8 +6,13 @@ import (
 	"encoding/json"
 	"expvar"
 	"fmt"
+	"math/rand"
 	"net/http"
 	"net/url"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -20,6 +25,15 @@ import (
 const (
 	defaultBatchSize = 300
 	defaultPeriod    = time.Minute
+
+	defaultBackoffBase = 500 * time.Millisecond
+	defaultBackoffCap  = 30 * time.Second
+	defaultMaxAttempts = 5
+
+	defaultMaxInflight           = 8
+	defaultMaxIdleConnsPerHost   = 8
+	defaultHTTPTimeout           = 30 * time.Second
+	defaultResponseHeaderTimeout = 10 * time.Second
 )
 
 type Provider struct {
@@ -29,11 +43,19 @@ type Provider struct {
 	points      map[string]*point
 	period      time.Duration
 
-	retryMax   int
-	retryDelay time.Duration
+	backoffBase time.Duration
+	backoffCap  time.Duration
+	maxAttempts int
+
+	batchSize   int
+	percentiles []float64
+	logError    func(err error)
 
-	batchSize int
-	logError  func(err error)
+	httpClient  *http.Client
+	maxInflight int
+
+	runtimeWhitelist []string
+	lastNumGC        uint32
 }
 
 type OptionFunc func(*Provider)
@@ -50,19 +72,77 @@ func WithPeriod(period time.Duration) OptionFunc {
 	}
 }
 
-func WithRetry(max int, delay time.Duration) OptionFunc {
+// WithBackoff configures the truncated exponential backoff with full
+// jitter used between retries of a failed post: each attempt after the
+// first waits a random duration between 0 and min(cap, base*2^attempt)
+// before trying again, for up to maxAttempts attempts total.
+func WithBackoff(base, cap time.Duration, maxAttempts int) OptionFunc {
 	return func(p *Provider) {
-		p.retryMax = max
-		p.retryDelay = delay
+		p.backoffBase = base
+		p.backoffCap = cap
+		p.maxAttempts = maxAttempts
+	}
+}
+
+// WithHTTPClient overrides the Provider's HTTP client, e.g. to inject
+// custom TLS config or instrumentation. By default the Provider uses its
+// own client with a tuned Transport rather than http.DefaultClient, so a
+// large flush doesn't share connections (or compete for them) with the
+// rest of the process.
+func WithHTTPClient(c *http.Client) OptionFunc {
+	return func(p *Provider) {
+		p.httpClient = c
+	}
+}
+
+// WithMaxInflight bounds how many batches write() posts concurrently,
+// gating the errgroup fan-out with a semaphore so flushing a large,
+// high-cardinality registry can't open an unbounded number of
+// connections and exhaust file descriptors.
+func WithMaxInflight(n int) OptionFunc {
+	return func(p *Provider) {
+		p.maxInflight = n
+	}
+}
+
+// WithPercentiles opts into the legacy per-quantile fan-out: for each
+// quantile given, an extra "<metric>.percNN" measurement is emitted
+// alongside the histogram's complex measurement. Most users don't need
+// this anymore since AppOptics can compute percentiles server-side from
+// the complex measurement, but it's kept for dashboards already built on
+// the old series names.
+func WithPercentiles(quantiles ...float64) OptionFunc {
+	return func(p *Provider) {
+		p.percentiles = quantiles
+	}
+}
+
+// WithRuntimeMetrics enables the periodic Go runtime metrics collector
+// integrated into SendLoop: on every send tick, the provider snapshots
+// runtime.MemStats and the goroutine count into its own gauges, and
+// observes new GC pause durations into a histogram, before the batch is
+// built. whitelist filters
+// which of those series are actually created: an empty slice collects
+// everything, while specific names (e.g. "runtime.mem.alloc") keep the
+// AppOptics measurement quota down. A nil whitelist disables the
+// collector, which is also the default.
+func WithRuntimeMetrics(whitelist []string) OptionFunc {
+	return func(p *Provider) {
+		p.runtimeWhitelist = whitelist
 	}
 }
 
 func NewProvider(opts ...OptionFunc) *Provider {
 	p := &Provider{
-		points:    map[string]*point{},
-		logError:  func(err error) {},
-		period:    defaultPeriod,
-		batchSize: defaultBatchSize,
+		points:      map[string]*point{},
+		logError:    func(err error) {},
+		period:      defaultPeriod,
+		batchSize:   defaultBatchSize,
+		backoffBase: defaultBackoffBase,
+		backoffCap:  defaultBackoffCap,
+		maxAttempts: defaultMaxAttempts,
+		httpClient:  newDefaultHTTPClient(),
+		maxInflight: defaultMaxInflight,
 	}
 
 	for _, o := range opts {
@@ -80,6 +160,9 @@ func (p *Provider) SendLoop(ctx context.Context, c <-chan time.Time, url *url.UR
 		case <-ctx.Done():
 			return
 		case <-c:
+			if p.runtimeWhitelist != nil {
+				p.sampleRuntimeMetrics(p.runtimeWhitelist)
+			}
 			if err := p.write(ctx, url, user, pass); err != nil {
 				p.logError(err)
 			}
@@ -87,6 +170,107 @@ func (p *Provider) SendLoop(ctx context.Context, c <-chan time.Time, url *url.UR
 	}
 }
 
+const (
+	metricRuntimeMemAlloc       = "runtime.mem.alloc"
+	metricRuntimeMemSys         = "runtime.mem.sys"
+	metricRuntimeMemHeapObjects = "runtime.mem.heap_objects"
+	metricRuntimeGoroutines     = "runtime.goroutines"
+	metricRuntimeGCPause        = "runtime.gc.pause"
+)
+
+// CollectRuntimeMetrics periodically snapshots the Go runtime (memory
+// stats, goroutine count, and GC pause durations) into the provider's own
+// gauges and histograms, until ctx is done. It runs on its own ticker and
+// is independent of SendLoop, for callers who want runtime metrics on a
+// different cadence or who only expose them via Handler.
+//
+// whitelist filters which series are created: an empty slice collects
+// everything, nil disables the collector entirely (CollectRuntimeMetrics
+// returns immediately).
+func (p *Provider) CollectRuntimeMetrics(ctx context.Context, interval time.Duration, whitelist []string) {
+	if whitelist == nil {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.sampleRuntimeMetrics(whitelist)
+		}
+	}
+}
+
+func (p *Provider) sampleRuntimeMetrics(whitelist []string) {
+	allow := func(name string) bool { return runtimeSeriesAllowed(whitelist, name) }
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	if allow(metricRuntimeMemAlloc) {
+		p.NewGauge(metrics.Identifier{Name: metricRuntimeMemAlloc}).Set(float64(mem.Alloc))
+	}
+	if allow(metricRuntimeMemSys) {
+		p.NewGauge(metrics.Identifier{Name: metricRuntimeMemSys}).Set(float64(mem.Sys))
+	}
+	if allow(metricRuntimeMemHeapObjects) {
+		p.NewGauge(metrics.Identifier{Name: metricRuntimeMemHeapObjects}).Set(float64(mem.HeapObjects))
+	}
+	if allow(metricRuntimeGoroutines) {
+		p.NewGauge(metrics.Identifier{Name: metricRuntimeGoroutines}).Set(float64(runtime.NumGoroutine()))
+	}
+	if allow(metricRuntimeGCPause) {
+		p.sampleGCPause()
+	}
+}
+
+// sampleGCPause observes the GC pauses that happened since the last call
+// into the runtime.gc.pause histogram, so repeated sampling doesn't
+// re-observe the same pauses. Only pauses still in the runtime's recorded
+// pause history are observed; older ones are skipped.
+func (p *Provider) sampleGCPause() {
+	var gc debug.GCStats
+	gc.PauseQuantiles = make([]time.Duration, 5)
+	debug.ReadGCStats(&gc)
+
+	p.mtx.Lock()
+	last := p.lastNumGC
+	p.lastNumGC = uint32(gc.NumGC)
+	p.mtx.Unlock()
+
+	n := uint32(gc.NumGC) - last
+	if n > uint32(len(gc.Pause)) {
+		n = uint32(len(gc.Pause))
+	}
+
+	h := p.NewHistogram(metrics.Identifier{Name: metricRuntimeGCPause})
+	for i := uint32(0); i < n; i++ {
+		h.Observe(gc.Pause[i].Seconds())
+	}
+}
+
+// runtimeSeriesAllowed reports whether name should be collected given a
+// runtime metrics whitelist: a nil whitelist disables collection
+// entirely, and an empty (non-nil) whitelist allows everything.
+func runtimeSeriesAllowed(whitelist []string, name string) bool {
+	if whitelist == nil {
+		return false
+	}
+	if len(whitelist) == 0 {
+		return true
+	}
+	for _, w := range whitelist {
+		if w == name {
+			return true
+		}
+	}
+	return false
+}
+
 func (p *Provider) write(ctx context.Context, url *url.URL, user, pass string) error {
 	requests, err := p.batchRequests(url, user, pass)
 	if err != nil {
@@ -96,10 +280,21 @@ func (p *Provider) write(ctx context.Context, url *url.URL, user, pass string) e
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	// Bound how many batches are in flight at once so a big flush can't
+	// open an unbounded number of connections to AppOptics.
+	sem := make(chan struct{}, p.maxInflight)
+
 	g := &errgroup{cancel: cancel}
 	for _, req := range requests {
 		req := req
 		g.Go(func() error {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			defer func() { <-sem }()
+
 			return p.retry(func() error { return p.post(req.WithContext(ctx)) })
 		})
 	}
@@ -107,31 +302,98 @@ func (p *Provider) write(ctx context.Context, url *url.URL, user, pass string) e
 	return g.Wait()
 }
 
+// retry calls work, retrying on failure up to p.maxAttempts times total.
+// It returns as soon as work succeeds. A permanent failure (4xx other
+// than 429) is returned immediately without retrying; anything else
+// backs off with full jitter between attempts, honoring a Retry-After
+// header if the server sent one.
 func (p *Provider) retry(work func() error) error {
-	retries := 0
-	for {
-		err := work()
-		if retries >= p.retryMax {
+	var err error
+	for attempt := 0; attempt < p.maxAttempts; attempt++ {
+		err = work()
+		if err == nil {
+			return nil
+		}
+
+		code, ok := err.(errUnexpectedCode)
+		if ok && !code.retryable() {
 			return err
 		}
-		time.Sleep(p.retryDelay)
-		retries++
+
+		if attempt == p.maxAttempts-1 {
+			break
+		}
+
+		delay := p.backoffDelay(attempt)
+		if ok && code.retryAfter > 0 {
+			delay = code.retryAfter
+		}
+		time.Sleep(delay)
+	}
+	return err
+}
+
+// backoffDelay returns a random duration between 0 and the truncated
+// exponential backoff ceiling for attempt (0-indexed): min(cap, base*2^attempt).
+func (p *Provider) backoffDelay(attempt int) time.Duration {
+	ceiling := p.backoffBase * time.Duration(int64(1)<<uint(attempt))
+	if ceiling <= 0 || ceiling > p.backoffCap {
+		ceiling = p.backoffCap
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// newDefaultHTTPClient builds the Provider's default HTTP client: its own
+// Transport, keeping a bounded pool of idle connections to a single
+// AppOptics host, rather than http.DefaultClient which is shared across
+// the whole process. The Transport does not cap the total number of open
+// connections; write() limits concurrent posts via maxInflight.
+func newDefaultHTTPClient() *http.Client {
+	return &http.Client{
+		Timeout: defaultHTTPTimeout,
+		Transport: &http.Transport{
+			MaxIdleConnsPerHost:   defaultMaxIdleConnsPerHost,
+			IdleConnTimeout:       90 * time.Second,
+			ResponseHeaderTimeout: defaultResponseHeaderTimeout,
+		},
 	}
 }
 
 func (p *Provider) post(req *http.Request) error {
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := p.httpClient.Do(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode/100 != 2 {
-		return errUnexpectedCode{code: resp.StatusCode}
+		e := errUnexpectedCode{code: resp.StatusCode}
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+			e.retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+		}
+		return e
 	}
 	return nil
 }
 
+// parseRetryAfter parses a Retry-After header, which may be given as
+// either a number of seconds or an HTTP date. It returns 0 if the header
+// is absent or unparseable, meaning "fall back to the backoff policy".
+func parseRetryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(header); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if when, err := http.ParseTime(header); err == nil {
+		if d := time.Until(when); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
 func (p *Provider) batchRequests(u *url.URL, user, pass string) ([]*http.Request, error) {
 	measurements := p.sample()
 	if len(measurements) == 0 {
@@ -172,7 +434,20 @@ func (p *Provider) batchRequests(u *url.URL, user, pass string) ([]*http.Request
 	return requests, nil
 }
 
+// sample takes a snapshot of every point for sending to AppOptics,
+// resetting counters and histogram accumulators for the next window.
 func (p *Provider) sample() []measurement {
+	return p.snapshot(true)
+}
+
+// peek takes a snapshot of every point without resetting anything, for
+// Handler, which operators use to see what's about to be sent without
+// disturbing the next real sample.
+func (p *Provider) peek() []measurement {
+	return p.snapshot(false)
+}
+
+func (p *Provider) snapshot(consume bool) []measurement {
 	p.mtx.Lock()
 	defer p.mtx.Unlock()
 
@@ -181,10 +456,13 @@ func (p *Provider) sample() []measurement {
 
 	ms := make([]measurement, 0, len(p.points))
 	for _, point := range p.points {
+		attrs := point.attrs
+		attrs.Aggregate = true
+
 		switch {
 		case point.float != nil:
 			v := point.float.Value()
-			if point.reset {
+			if consume && point.reset {
 				point.float.Set(0)
 			}
 
@@ -192,30 +470,52 @@ func (p *Provider) sample() []measurement {
 				Name:       point.name,
 				Time:       ts.Unix(),
 				Period:     period,
-				Attributes: attributes{Aggregate: true},
+				Attributes: attrs,
 				Tags:       point.keyvals,
-				Value:      v,
+				Value:      floatPtr(v),
 			})
 
 		case point.histogram != nil:
-			for _, pair := range []struct {
-				suffix   string
-				quantile float64
-			}{
-				{".perc50", 0.50},
-				{".perc90", 0.90},
-				{".perc95", 0.95},
-				{".perc99", 0.99},
-			} {
+			// Quantiles must be read before Sample(), which resets the
+			// reservoir they're computed from as part of taking the
+			// window snapshot; reading them after would always see an
+			// empty reservoir and report a constant 0.
+			quantiles := make([]float64, len(p.percentiles))
+			for i, q := range p.percentiles {
+				quantiles[i] = point.histogram.Quantile(q)
+			}
+
+			var stats internalhistogram.Stats
+			if consume {
+				stats = point.histogram.Sample()
+			} else {
+				stats = point.histogram.Peek()
+			}
+
+			if stats.Count > 0 {
 				ms = append(ms, measurement{
-					Name:       point.name + pair.suffix,
+					Name:       point.name,
 					Time:       ts.Unix(),
 					Period:     period,
-					Attributes: attributes{Aggregate: true},
+					Attributes: attrs,
 					Tags:       point.keyvals,
-					Value:      point.histogram.Quantile(pair.quantile),
+					Count:      floatPtr(stats.Count),
+					Sum:        floatPtr(stats.Sum),
+					Min:        floatPtr(stats.Min),
+					Max:        floatPtr(stats.Max),
+					SumSquares: floatPtr(stats.SumSquares),
 				})
+			}
 
+			for i, q := range p.percentiles {
+				ms = append(ms, measurement{
+					Name:       point.name + percentileSuffix(q),
+					Time:       ts.Unix(),
+					Period:     period,
+					Attributes: attrs,
+					Tags:       point.keyvals,
+					Value:      floatPtr(quantiles[i]),
+				})
 			}
 		}
 	}
@@ -223,6 +523,105 @@ func (p *Provider) sample() []measurement {
 	return ms
 }
 
+// Handler serves the provider's current in-memory points without
+// resetting any counters, for debugging what's about to be sent to
+// AppOptics (curl /debug/metrics) and for hybrid deployments that want
+// to be scraped by Prometheus alongside the push-based SendLoop.
+//
+// It content-negotiates on the Accept header: a request that accepts
+// "text/plain" gets Prometheus exposition format, with histograms
+// rendered as Prometheus summaries using the quantiles configured via
+// WithPercentiles; anything else gets a JSON document of the same
+// measurements SendLoop would have posted.
+func (p *Provider) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if acceptsPrometheusText(r.Header.Get("Accept")) {
+			p.writePrometheus(w)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(p.peek())
+	})
+}
+
+func acceptsPrometheusText(accept string) bool {
+	return strings.Contains(accept, "text/plain")
+}
+
+func (p *Provider) writePrometheus(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	for _, point := range p.points {
+		name := prometheusName(point.name)
+		labels := prometheusLabels(point.keyvals)
+
+		switch {
+		case point.float != nil:
+			fmt.Fprintf(w, "%s%s %v\n", name, labels, point.float.Value())
+
+		case point.histogram != nil:
+			stats := point.histogram.Peek()
+			for _, q := range p.percentiles {
+				quantileLabels := prometheusLabels(withTag(point.keyvals, "quantile", strconv.FormatFloat(q, 'g', -1, 64)))
+				fmt.Fprintf(w, "%s%s %v\n", name, quantileLabels, point.histogram.Quantile(q))
+			}
+			fmt.Fprintf(w, "%s_sum%s %v\n", name, labels, stats.Sum)
+			fmt.Fprintf(w, "%s_count%s %v\n", name, labels, stats.Count)
+		}
+	}
+}
+
+// prometheusName maps an AppOptics-style dotted metric name to the
+// underscored form Prometheus expects.
+func prometheusName(name string) string {
+	return strings.NewReplacer(".", "_", "-", "_").Replace(name)
+}
+
+// prometheusLabels renders tags as a Prometheus label set, e.g.
+// {region="us",system="test"}. Keys are sorted for stable output.
+func prometheusLabels(tags map[string]string) string {
+	if len(tags) == 0 {
+		return ""
+	}
+
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = fmt.Sprintf("%s=%q", k, tags[k])
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// withTag returns a copy of tags with key/value added, for attaching a
+// "quantile" label to a histogram's tags without mutating the point.
+func withTag(tags map[string]string, key, value string) map[string]string {
+	merged := make(map[string]string, len(tags)+1)
+	for k, v := range tags {
+		merged[k] = v
+	}
+	merged[key] = value
+	return merged
+}
+
+// percentileSuffix names the legacy fan-out series for a quantile, e.g.
+// 0.99 becomes ".perc99".
+func percentileSuffix(q float64) string {
+	return fmt.Sprintf(".perc%d", int(q*100))
+}
+
+func floatPtr(v float64) *float64 {
+	return &v
+}
+
 type measurement struct {
 	Name   string `json:"name"`
 	Time   int64  `json:"time"`
@@ -231,25 +630,132 @@ type measurement struct {
 	Attributes attributes        `json:"attributes,omitempty"`
 	Tags       map[string]string `json:"tags"`
 
-	Value float64 `json:"value"`
+	// Value is set for simple measurements: counters, gauges, and the
+	// opt-in percentile fan-out.
+	Value *float64 `json:"value,omitempty"`
+
+	// Count, Sum, Min, Max and SumSquares are set together for AppOptics
+	// "complex measurements", which is how histograms are reported by
+	// default so AppOptics can compute percentiles server-side and
+	// re-aggregate across tag combinations instead of us baking in a
+	// fixed quantile set.
+	Count      *float64 `json:"count,omitempty"`
+	Sum        *float64 `json:"sum,omitempty"`
+	Min        *float64 `json:"min,omitempty"`
+	Max        *float64 `json:"max,omitempty"`
+	SumSquares *float64 `json:"sum_squares,omitempty"`
 }
 
 type attributes struct {
 	Aggregate bool `json:"aggregate"`
+
+	// DisplayUnitsShort/Long, DisplayStacked, DisplayMin/Max,
+	// SummarizeFunction, Color, and CreatedByUA are how a metric gets
+	// rendered correctly in AppOptics (e.g. as ms/µs/s) instead of a
+	// bare number. They're set at metric registration via
+	// NewHistogramWithUnits/NewHistogramWithAttributes and friends, and
+	// carried through to every measurement for that metric.
+	DisplayUnitsShort string   `json:"display_units_short,omitempty"`
+	DisplayUnitsLong  string   `json:"display_units_long,omitempty"`
+	DisplayStacked    *bool    `json:"display_stacked,omitempty"`
+	DisplayMin        *float64 `json:"display_min,omitempty"`
+	DisplayMax        *float64 `json:"display_max,omitempty"`
+	SummarizeFunction string   `json:"summarize_function,omitempty"`
+	Color             string   `json:"color,omitempty"`
+	CreatedByUA       string   `json:"created_by_ua,omitempty"`
+}
+
+// attributesFromMap builds AppOptics display attributes from a generic
+// map, as accepted by NewCounterWithAttributes/NewGaugeWithAttributes/
+// NewHistogramWithAttributes. Unrecognized keys and values of the wrong
+// type are ignored rather than causing a panic, since this is
+// registration-time configuration.
+func attributesFromMap(m map[string]interface{}) attributes {
+	var attrs attributes
+	if s, ok := m["display_units_short"].(string); ok {
+		attrs.DisplayUnitsShort = s
+	}
+	if s, ok := m["display_units_long"].(string); ok {
+		attrs.DisplayUnitsLong = s
+	}
+	if b, ok := m["display_stacked"].(bool); ok {
+		attrs.DisplayStacked = &b
+	}
+	if f, ok := m["display_min"].(float64); ok {
+		attrs.DisplayMin = &f
+	}
+	if f, ok := m["display_max"].(float64); ok {
+		attrs.DisplayMax = &f
+	}
+	if s, ok := m["summarize_function"].(string); ok {
+		attrs.SummarizeFunction = s
+	}
+	if s, ok := m["color"].(string); ok {
+		attrs.Color = s
+	}
+	if s, ok := m["created_by_ua"].(string); ok {
+		attrs.CreatedByUA = s
+	}
+	return attrs
+}
+
+// durationAttributes derives the AppOptics display attributes for a
+// latency metric measured in unit, e.g. time.Millisecond gives
+// display_units_short "ms", display_units_long "milliseconds", and
+// summarize_function "average".
+func durationAttributes(unit time.Duration) attributes {
+	short, long := durationUnitNames(unit)
+	return attributes{
+		DisplayUnitsShort: short,
+		DisplayUnitsLong:  long,
+		SummarizeFunction: "average",
+	}
+}
+
+func durationUnitNames(unit time.Duration) (short, long string) {
+	switch unit {
+	case time.Nanosecond:
+		return "ns", "nanoseconds"
+	case time.Microsecond:
+		return "µs", "microseconds"
+	case time.Millisecond:
+		return "ms", "milliseconds"
+	case time.Second:
+		return "s", "seconds"
+	default:
+		return "", ""
+	}
 }
 
 type errUnexpectedCode struct {
-	code int
+	code       int
+	retryAfter time.Duration
 }
 
 func (e errUnexpectedCode) Error() string {
 	return fmt.Sprintf("Expected 2xx, got %d", e.code)
 }
 
+// retryable reports whether this status code is worth retrying. 429 and
+// 503 are always retryable; other 4xx are permanent client errors (bad
+// auth, malformed body, ...) that won't succeed on retry; everything
+// else (5xx, unexpected codes) falls back to the backoff policy.
+func (e errUnexpectedCode) retryable() bool {
+	switch {
+	case e.code == http.StatusTooManyRequests, e.code == http.StatusServiceUnavailable:
+		return true
+	case e.code/100 == 4:
+		return false
+	default:
+		return true
+	}
+}
+
 type point struct {
 	name    string
 	keyvals map[string]string
 	reset   bool
+	attrs   attributes
 
 	float     *expvar.Float
 	histogram *internalhistogram.Histogram
@@ -268,43 +774,80 @@ func (p *point) Observe(v float64) {
 }
 
 func (p *Provider) NewCounter(id metrics.Identifier) metrics.Counter {
+	return p.NewCounterWithAttributes(id, nil)
+}
+
+func (p *Provider) NewGauge(id metrics.Identifier) metrics.Gauge {
+	return p.NewGaugeWithAttributes(id, nil)
+}
+
+func (p *Provider) NewHistogram(id metrics.Identifier) metrics.Histogram {
+	return p.NewHistogramWithAttributes(id, nil)
+}
+
+// NewCounterWithAttributes is NewCounter plus AppOptics display
+// attributes (display_units_short, color, ...) attached at registration.
+// See attributesFromMap for the accepted keys.
+func (p *Provider) NewCounterWithAttributes(id metrics.Identifier, attrs map[string]interface{}) metrics.Counter {
 	return &counter{
 		parent:  p,
 		name:    id.Name,
 		keyvals: p.keyvals(id.Labels),
 		labels:  p.labels(id.Labels),
+		attrs:   attributesFromMap(attrs),
 	}
 }
 
-func (p *Provider) NewGauge(id metrics.Identifier) metrics.Gauge {
+// NewGaugeWithAttributes is NewGauge plus AppOptics display attributes
+// attached at registration. See attributesFromMap for the accepted keys.
+func (p *Provider) NewGaugeWithAttributes(id metrics.Identifier, attrs map[string]interface{}) metrics.Gauge {
 	return &gauge{
 		parent:  p,
 		name:    id.Name,
 		keyvals: p.keyvals(id.Labels),
 		labels:  p.labels(id.Labels),
+		attrs:   attributesFromMap(attrs),
 	}
 }
 
-func (p *Provider) NewHistogram(id metrics.Identifier) metrics.Histogram {
+// NewHistogramWithAttributes is NewHistogram plus AppOptics display
+// attributes attached at registration. See attributesFromMap for the
+// accepted keys.
+func (p *Provider) NewHistogramWithAttributes(id metrics.Identifier, attrs map[string]interface{}) metrics.Histogram {
+	return &histogram{
+		parent:  p,
+		name:    id.Name,
+		keyvals: p.keyvals(id.Labels),
+		labels:  p.labels(id.Labels),
+		attrs:   attributesFromMap(attrs),
+	}
+}
+
+// NewHistogramWithUnits is a convenience wrapper around
+// NewHistogramWithAttributes that fills in display_units_short,
+// display_units_long, and summarize_function for a latency histogram
+// measured in unit, e.g. time.Millisecond renders as ms/milliseconds.
+func (p *Provider) NewHistogramWithUnits(id metrics.Identifier, unit time.Duration) metrics.Histogram {
 	return &histogram{
 		parent:  p,
 		name:    id.Name,
 		keyvals: p.keyvals(id.Labels),
 		labels:  p.labels(id.Labels),
+		attrs:   durationAttributes(unit),
 	}
 }
 
-func (p *Provider) point(key, name string, reset bool, keyvals map[string]string) *point {
+func (p *Provider) point(key, name string, reset bool, keyvals map[string]string, attrs attributes) *point {
 	p.mtx.Lock()
 	defer p.mtx.Unlock()
 
 	if _, ok := p.points[key]; !ok {
-		p.points[key] = &point{name: name, reset: reset, keyvals: keyvals, float: new(expvar.Float)}
+		p.points[key] = &point{name: name, reset: reset, keyvals: keyvals, attrs: attrs, float: new(expvar.Float)}
 	}
 	return p.points[key]
 }
 
-func (p *Provider) observe(key, name string, keyvals map[string]string, value float64) {
+func (p *Provider) observe(key, name string, keyvals map[string]string, value float64, attrs attributes) {
 	p.mtx.Lock()
 	defer p.mtx.Unlock()
 
@@ -312,6 +855,7 @@ func (p *Provider) observe(key, name string, keyvals map[string]string, value fl
 		p.points[key] = &point{
 			name:      name,
 			keyvals:   keyvals,
+			attrs:     attrs,
 			histogram: internalhistogram.New(),
 		}
 	}
@@ -344,6 +888,7 @@ type counter struct {
 	name    string
 	keyvals map[string]string
 	labels  []string
+	attrs   attributes
 }
 
 func (c *counter) With(keyvals ...string) metrics.Counter {
@@ -352,12 +897,13 @@ func (c *counter) With(keyvals ...string) metrics.Counter {
 		name:    c.name,
 		keyvals: keyval.Merge(c.keyvals, keyvals...),
 		labels:  c.labels,
+		attrs:   c.attrs,
 	}
 }
 
 func (c *counter) Add(delta float64) {
 	key := key(c.name, c.labels, c.keyvals)
-	c.parent.point(key, c.name, true, c.keyvals).Add(delta)
+	c.parent.point(key, c.name, true, c.keyvals, c.attrs).Add(delta)
 }
 
 type gauge struct {
@@ -365,6 +911,7 @@ type gauge struct {
 	name    string
 	labels  []string
 	keyvals map[string]string
+	attrs   attributes
 }
 
 func (g *gauge) With(keyvals ...string) metrics.Gauge {
@@ -373,17 +920,18 @@ func (g *gauge) With(keyvals ...string) metrics.Gauge {
 		name:    g.name,
 		keyvals: keyval.Merge(g.keyvals, keyvals...),
 		labels:  g.labels,
+		attrs:   g.attrs,
 	}
 }
 
 func (g *gauge) Set(value float64) {
 	key := key(g.name, g.labels, g.keyvals)
-	g.parent.point(key, g.name, false, g.keyvals).Set(value)
+	g.parent.point(key, g.name, false, g.keyvals, g.attrs).Set(value)
 }
 
 func (g *gauge) Add(delta float64) {
 	key := key(g.name, g.labels, g.keyvals)
-	g.parent.point(key, g.name, false, g.keyvals).Add(delta)
+	g.parent.point(key, g.name, false, g.keyvals, g.attrs).Add(delta)
 }
 
 type histogram struct {
@@ -391,6 +939,7 @@ type histogram struct {
 	name    string
 	labels  []string
 	keyvals map[string]string
+	attrs   attributes
 }
 
 func (h *histogram) With(keyvals ...string) metrics.Histogram {
@@ -399,12 +948,13 @@ func (h *histogram) With(keyvals ...string) metrics.Histogram {
 		name:    h.name,
 		keyvals: keyval.Merge(h.keyvals, keyvals...),
 		labels:  h.labels,
+		attrs:   h.attrs,
 	}
 }
 
 func (h *histogram) Observe(value float64) {
 	key := key(h.name, h.labels, h.keyvals)
-	h.parent.observe(key, h.name, h.keyvals, value)
+	h.parent.observe(key, h.name, h.keyvals, value, h.attrs)
 }
 
 func key(name string, labels []string, keyvals map[string]string) string {
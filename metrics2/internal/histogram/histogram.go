@@ -0,0 +1,123 @@
+// Package histogram implements a concurrent-safe streaming histogram used
+// by metrics2 providers to turn Observe calls into quantile estimates and
+// summary statistics.
+package histogram
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+// reservoirSize bounds the number of observations kept for quantile
+// estimation so memory use doesn't grow with traffic.
+const reservoirSize = 1000
+
+// Histogram is a concurrent-safe streaming histogram. It keeps a bounded
+// reservoir of observations for quantile estimation, alongside running
+// count/sum/min/max/sum-of-squares accumulators.
+type Histogram struct {
+	mtx sync.Mutex
+
+	reservoir []float64
+	seen      int
+
+	count      float64
+	sum        float64
+	min        float64
+	max        float64
+	sumSquares float64
+}
+
+// New returns a ready-to-use Histogram.
+func New() *Histogram {
+	return &Histogram{}
+}
+
+// Observe records a value.
+func (h *Histogram) Observe(v float64) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if h.count == 0 {
+		h.min, h.max = v, v
+	} else if v < h.min {
+		h.min = v
+	} else if v > h.max {
+		h.max = v
+	}
+
+	h.count++
+	h.sum += v
+	h.sumSquares += v * v
+
+	h.seen++
+	switch {
+	case len(h.reservoir) < reservoirSize:
+		h.reservoir = append(h.reservoir, v)
+	default:
+		if j := rand.Intn(h.seen); j < reservoirSize {
+			h.reservoir[j] = v
+		}
+	}
+}
+
+// Stats is a point-in-time snapshot of the accumulators.
+type Stats struct {
+	Count      float64
+	Sum        float64
+	Min        float64
+	Max        float64
+	SumSquares float64
+}
+
+// Sample returns the accumulated stats for the current window and resets
+// the accumulators, including the quantile reservoir, so the next call
+// reports only values observed since this one.
+func (h *Histogram) Sample() Stats {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	stats := Stats{Count: h.count, Sum: h.sum, Min: h.min, Max: h.max, SumSquares: h.sumSquares}
+
+	h.count, h.sum, h.min, h.max, h.sumSquares = 0, 0, 0, 0, 0
+	h.reservoir = nil
+	h.seen = 0
+
+	return stats
+}
+
+// Peek returns the current accumulated stats without resetting them, for
+// callers (like a debug/scrape handler) that want to observe the current
+// window without consuming it.
+func (h *Histogram) Peek() Stats {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	return Stats{Count: h.count, Sum: h.sum, Min: h.min, Max: h.max, SumSquares: h.sumSquares}
+}
+
+// Quantile returns an estimate of the given quantile (0..1) from the
+// observations in the current window, without resetting it.
+func (h *Histogram) Quantile(q float64) float64 {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if len(h.reservoir) == 0 {
+		return 0
+	}
+
+	sorted := make([]float64, len(h.reservoir))
+	copy(sorted, h.reservoir)
+	sort.Float64s(sorted)
+
+	idx := int(math.Ceil(q*float64(len(sorted)))) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	if idx >= len(sorted) {
+		idx = len(sorted) - 1
+	}
+	return sorted[idx]
+}
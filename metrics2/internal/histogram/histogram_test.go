@@ -0,0 +1,49 @@
+package histogram
+
+import "testing"
+
+func TestObserveAndSample(t *testing.T) {
+	h := New()
+	h.Observe(1)
+	h.Observe(2)
+	h.Observe(3)
+
+	stats := h.Sample()
+	if want, got := 3.0, stats.Count; want != got {
+		t.Fatalf("want count %f, got %f", want, got)
+	}
+	if want, got := 6.0, stats.Sum; want != got {
+		t.Fatalf("want sum %f, got %f", want, got)
+	}
+	if want, got := 1.0, stats.Min; want != got {
+		t.Fatalf("want min %f, got %f", want, got)
+	}
+	if want, got := 3.0, stats.Max; want != got {
+		t.Fatalf("want max %f, got %f", want, got)
+	}
+	if want, got := 14.0, stats.SumSquares; want != got {
+		t.Fatalf("want sum_squares %f, got %f", want, got)
+	}
+
+	// Sample resets the accumulators.
+	again := h.Sample()
+	if want, got := 0.0, again.Count; want != got {
+		t.Fatalf("want count to reset to %f, got %f", want, got)
+	}
+}
+
+func TestQuantile(t *testing.T) {
+	h := New()
+	for i := 1; i <= 100; i++ {
+		h.Observe(float64(i))
+	}
+
+	if want, got := 99.0, h.Quantile(0.99); want != got {
+		t.Fatalf("want p99 %f, got %f", want, got)
+	}
+
+	// Quantile doesn't reset the reservoir.
+	if want, got := 99.0, h.Quantile(0.99); want != got {
+		t.Fatalf("want p99 %f on second read, got %f", want, got)
+	}
+}